@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// FileMeta is the backend-agnostic view of a single file or directory
+// entry, returned by Backend.Stat and Backend.ReadDir.
+type FileMeta struct {
+	Name    string
+	Size    int64
+	IsDir   bool
+	ModTime time.Time
+}
+
+// ChunkWriter accepts upload chunks addressed by byte offset. The local
+// backend implements it as a WriteAt into a sparse file (see
+// localChunkWriter); the S3 backend maps each call straight onto an
+// UploadPart, so a chunked upload never touches local disk.
+type ChunkWriter interface {
+	WriteAt(data []byte, offset int64) error
+	// Complete finalizes the upload (renaming the local part file into
+	// place, or completing the S3 multipart upload).
+	Complete() error
+	// Abort discards any partial state without finalizing it.
+	Abort() error
+	// Token returns an opaque resume handle for this writer (an S3
+	// multipart upload ID; empty for the local backend, which needs
+	// none since reopening the same path is already idempotent). The
+	// caller persists it and passes it back to Backend.OpenChunkWriter
+	// to resume the same backend-side write from a later request.
+	Token() string
+}
+
+// Backend abstracts the storage operations handleList, handleUpload,
+// handleDownload and ChunkedUpload need, so ezdrop can serve either a
+// local chroot or an S3-compatible object store through the same HTTP
+// handlers. Paths passed to Backend methods are slash-separated and
+// relative to the backend's root (baseDir for the local backend, S3Prefix
+// for the S3 backend); implementations are responsible for rejecting
+// paths that escape that root.
+type Backend interface {
+	Stat(path string) (FileMeta, error)
+	ReadDir(path string) ([]FileMeta, error)
+	Open(path string) (io.ReadCloser, int64, error)
+	Create(path string) (io.WriteCloser, error)
+	// OpenChunkWriter opens a ChunkWriter for path. token is empty for a
+	// brand new upload, or a previously-returned ChunkWriter.Token() to
+	// resume one a prior request already started.
+	OpenChunkWriter(path string, totalSize int64, token string) (ChunkWriter, error)
+	Remove(path string) error
+	Rename(oldPath, newPath string) error
+	// PresignGET returns a time-limited URL serving path directly from
+	// the backend, or ok=false if the backend can't presign (the local
+	// backend never can; the caller should stream the file itself).
+	PresignGET(path string, expires time.Duration) (url string, ok bool)
+}
+
+// BackendConfig selects and configures a Backend via -backend and its
+// supporting env vars.
+type BackendConfig struct {
+	Kind    string // "local" or "s3"
+	BaseDir string // local backend root
+
+	S3Bucket    string
+	S3Endpoint  string
+	S3Prefix    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+}
+
+// NewBackend constructs the Backend selected by cfg.Kind.
+func NewBackend(cfg BackendConfig) (Backend, error) {
+	switch cfg.Kind {
+	case "", "local":
+		return newLocalBackend(cfg.BaseDir), nil
+	case "s3":
+		return newS3Backend(cfg)
+	default:
+		return nil, fmt.Errorf("unknown backend %q (want \"local\" or \"s3\")", cfg.Kind)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localBackend implements Backend directly against the chroot directory
+// on local disk; it's the default and the only backend that existed
+// before pluggable storage was added.
+type localBackend struct {
+	baseDir string
+}
+
+func newLocalBackend(baseDir string) *localBackend {
+	return &localBackend{baseDir: baseDir}
+}
+
+// resolve joins path onto baseDir and rejects anything that escapes it,
+// the same chroot check the HTTP handlers already apply to query params.
+func (b *localBackend) resolve(path string) (string, error) {
+	full := filepath.Join(b.baseDir, path)
+	if !strings.HasPrefix(full, b.baseDir) {
+		return "", os.ErrPermission
+	}
+	return full, nil
+}
+
+func (b *localBackend) Stat(path string) (FileMeta, error) {
+	full, err := b.resolve(path)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	return FileMeta{Name: info.Name(), Size: info.Size(), IsDir: info.IsDir(), ModTime: info.ModTime()}, nil
+}
+
+func (b *localBackend) ReadDir(path string) ([]FileMeta, error) {
+	full, err := b.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(full)
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]FileMeta, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		metas = append(metas, FileMeta{Name: entry.Name(), Size: info.Size(), IsDir: entry.IsDir(), ModTime: info.ModTime()})
+	}
+	return metas, nil
+}
+
+func (b *localBackend) Open(path string) (io.ReadCloser, int64, error) {
+	full, err := b.resolve(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (b *localBackend) Create(path string) (io.WriteCloser, error) {
+	full, err := b.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(full)
+}
+
+// OpenChunkWriter writes to a "<path>.part" sibling of the target so a
+// reader never sees a partially-written file; Complete fsyncs and renames
+// it into place. token is ignored: reopening the same ".part" path (with
+// O_CREATE, no O_TRUNC) is already idempotent, so the local backend
+// needs no resume handle.
+func (b *localBackend) OpenChunkWriter(path string, totalSize int64, token string) (ChunkWriter, error) {
+	full, err := b.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	partPath := full + ".part"
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(totalSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &localChunkWriter{partPath: partPath, finalPath: full}, nil
+}
+
+func (b *localBackend) Remove(path string) error {
+	full, err := b.resolve(path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(full)
+}
+
+func (b *localBackend) Rename(oldPath, newPath string) error {
+	oldFull, err := b.resolve(oldPath)
+	if err != nil {
+		return err
+	}
+	newFull, err := b.resolve(newPath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldFull, newFull)
+}
+
+// PresignGET is a no-op for the local backend: there's no remote URL to
+// redirect to, so handleDownload falls back to streaming the file itself.
+func (b *localBackend) PresignGET(path string, expires time.Duration) (string, bool) {
+	return "", false
+}
+
+// localChunkWriter writes chunks directly at their offset into a single
+// sparse ".part" file. Each ChunkedUpload (and so each ChunkWriter) only
+// lives for the span of one HTTP request, but a multi-chunk upload is
+// resumed across many requests, so the writer must not hold the ".part"
+// file open between calls: WriteAt opens, writes, and closes it for each
+// chunk, the same way the dedupe path in chunkedupload.go already does.
+type localChunkWriter struct {
+	partPath  string
+	finalPath string
+}
+
+func (w *localChunkWriter) WriteAt(data []byte, offset int64) error {
+	f, err := os.OpenFile(w.partPath, os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+func (w *localChunkWriter) Complete() error {
+	f, err := os.OpenFile(w.partPath, os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.partPath, w.finalPath)
+}
+
+func (w *localChunkWriter) Abort() error {
+	return os.Remove(w.partPath)
+}
+
+func (w *localChunkWriter) Token() string { return "" }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Backend implements Backend against an S3-compatible object store.
+// Backblaze B2 is served through its own S3-compatible endpoint, so this
+// same driver covers both -backend=s3 targets; only S3Endpoint and the
+// credentials differ between them.
+type s3Backend struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+	prefix  string
+}
+
+func newS3Backend(cfg BackendConfig) (*s3Backend, error) {
+	if cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("EZDROP_S3_BUCKET is required for -backend=s3")
+	}
+
+	ctx := context.Background()
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.S3Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.S3Region))
+	}
+	if cfg.S3AccessKey != "" && cfg.S3SecretKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		// Most S3-compatible providers (B2 included) require path-style
+		// addressing rather than AWS's default virtual-hosted-style.
+		o.UsePathStyle = true
+	})
+
+	return &s3Backend{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  cfg.S3Bucket,
+		prefix:  strings.Trim(cfg.S3Prefix, "/"),
+	}, nil
+}
+
+// key maps a slash-separated path relative to the backend root onto a
+// full S3 object key under s3Prefix.
+func (b *s3Backend) key(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	if b.prefix == "" {
+		return p
+	}
+	if p == "" {
+		return b.prefix
+	}
+	return path.Join(b.prefix, p)
+}
+
+func (b *s3Backend) Stat(p string) (FileMeta, error) {
+	ctx := context.Background()
+	key := b.key(p)
+
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &b.bucket, Key: &key})
+	if err == nil {
+		var size int64
+		if out.ContentLength != nil {
+			size = *out.ContentLength
+		}
+		var modTime time.Time
+		if out.LastModified != nil {
+			modTime = *out.LastModified
+		}
+		return FileMeta{Name: path.Base(p), Size: size, ModTime: modTime}, nil
+	}
+
+	// Not an object; see if it's a "directory" (a common prefix with at
+	// least one object under it), since S3 has no real directories.
+	dirKey := key
+	if dirKey != "" && !strings.HasSuffix(dirKey, "/") {
+		dirKey += "/"
+	}
+	listOut, listErr := b.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &b.bucket,
+		Prefix:  &dirKey,
+		MaxKeys: aws.Int32(1),
+	})
+	if listErr == nil && len(listOut.Contents) > 0 {
+		return FileMeta{Name: path.Base(p), IsDir: true}, nil
+	}
+	return FileMeta{}, err
+}
+
+func (b *s3Backend) ReadDir(p string) ([]FileMeta, error) {
+	ctx := context.Background()
+	prefix := b.key(p)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var metas []FileMeta
+	var continuationToken *string
+	for {
+		out, err := b.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &b.bucket,
+			Prefix:            &prefix,
+			Delimiter:         aws.String("/"),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cp := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(*cp.Prefix, prefix), "/")
+			metas = append(metas, FileMeta{Name: name, IsDir: true})
+		}
+		for _, obj := range out.Contents {
+			name := strings.TrimPrefix(*obj.Key, prefix)
+			if name == "" {
+				continue
+			}
+			meta := FileMeta{Name: name}
+			if obj.Size != nil {
+				meta.Size = *obj.Size
+			}
+			if obj.LastModified != nil {
+				meta.ModTime = *obj.LastModified
+			}
+			metas = append(metas, meta)
+		}
+
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			break
+		}
+		continuationToken = out.NextContinuationToken
+	}
+	return metas, nil
+}
+
+func (b *s3Backend) Open(p string) (io.ReadCloser, int64, error) {
+	ctx := context.Background()
+	key := b.key(p)
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &b.bucket, Key: &key})
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if out.ContentLength != nil {
+		size = *out.ContentLength
+	}
+	return out.Body, size, nil
+}
+
+// Create buffers the full write in memory before issuing a single
+// PutObject, since S3 has no append/streaming-write primitive; large
+// writes should go through OpenChunkWriter's multipart path instead.
+func (b *s3Backend) Create(p string) (io.WriteCloser, error) {
+	return &s3PutWriter{backend: b, key: b.key(p)}, nil
+}
+
+// OpenChunkWriter starts a new S3 multipart upload, or resumes one from a
+// ChunkWriter.Token() a prior request already started (each chunk POST
+// reconstructs its own ChunkedUpload/ChunkWriter, so this runs once per
+// request, not once per upload): resuming re-lists the upload's already
+// completed parts via ListParts instead of creating a second multipart
+// upload and losing track of the first.
+func (b *s3Backend) OpenChunkWriter(p string, totalSize int64, token string) (ChunkWriter, error) {
+	ctx := context.Background()
+	key := b.key(p)
+
+	if token != "" {
+		cw := &s3ChunkWriter{backend: b, key: key, uploadID: token, totalSize: totalSize}
+		if err := cw.loadCompletedParts(ctx); err != nil {
+			return nil, fmt.Errorf("resuming multipart upload %s: %w", token, err)
+		}
+		return cw, nil
+	}
+
+	out, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating multipart upload: %w", err)
+	}
+
+	return &s3ChunkWriter{
+		backend:   b,
+		key:       key,
+		uploadID:  *out.UploadId,
+		totalSize: totalSize,
+	}, nil
+}
+
+func (b *s3Backend) Remove(p string) error {
+	ctx := context.Background()
+	key := b.key(p)
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &b.bucket, Key: &key})
+	return err
+}
+
+func (b *s3Backend) Rename(oldPath, newPath string) error {
+	ctx := context.Background()
+	oldKey, newKey := b.key(oldPath), b.key(newPath)
+	source := b.bucket + "/" + oldKey
+	if _, err := b.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &b.bucket,
+		Key:        &newKey,
+		CopySource: &source,
+	}); err != nil {
+		return fmt.Errorf("copying %s to %s: %w", oldPath, newPath, err)
+	}
+	return b.Remove(oldPath)
+}
+
+func (b *s3Backend) PresignGET(p string, expires time.Duration) (string, bool) {
+	ctx := context.Background()
+	key := b.key(p)
+	req, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", false
+	}
+	return req.URL, true
+}
+
+// s3PutWriter buffers a Create() write and flushes it as one PutObject on
+// Close, for the simple (non-chunked, non-dedupe) upload path.
+type s3PutWriter struct {
+	backend *s3Backend
+	key     string
+	buf     bytes.Buffer
+}
+
+func (w *s3PutWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *s3PutWriter) Close() error {
+	_, err := w.backend.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: &w.backend.bucket,
+		Key:    &w.key,
+		Body:   bytes.NewReader(w.buf.Bytes()),
+	})
+	return err
+}
+
+// s3ChunkWriter maps each WriteChunk call straight onto an S3 UploadPart
+// call, so a chunked upload is relayed to object storage without ever
+// spooling to local disk. The part number is derived from the chunk's
+// byte offset (offset/partSize + 1), not call-arrival order, so chunks
+// may arrive out of order or be retransmitted (as chunk0-5's hash-mismatch
+// retry and resumed uploads both do) without scrambling the assembled
+// file; partSize is pinned to the length of the first chunk written,
+// which requires every chunk but the last to share that size.
+type s3ChunkWriter struct {
+	backend   *s3Backend
+	key       string
+	uploadID  string
+	totalSize int64
+
+	mu        sync.Mutex
+	partSize  int64
+	completed map[int32]types.CompletedPart
+}
+
+func (w *s3ChunkWriter) WriteAt(data []byte, offset int64) error {
+	w.mu.Lock()
+	if w.partSize == 0 {
+		w.partSize = int64(len(data))
+	}
+	partSize := w.partSize
+	w.mu.Unlock()
+
+	if partSize <= 0 || offset%partSize != 0 {
+		return fmt.Errorf("s3 backend requires chunks aligned to a fixed part size (got offset %d, part size %d)", offset, partSize)
+	}
+	partNumber := int32(offset/partSize) + 1
+
+	out, err := w.backend.client.UploadPart(context.Background(), &s3.UploadPartInput{
+		Bucket:     &w.backend.bucket,
+		Key:        &w.key,
+		UploadId:   &w.uploadID,
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading part %d: %w", partNumber, err)
+	}
+
+	w.mu.Lock()
+	if w.completed == nil {
+		w.completed = make(map[int32]types.CompletedPart)
+	}
+	// A retransmitted chunk re-uploads the same part number; keep only
+	// the latest ETag for it rather than completing with a duplicate.
+	w.completed[partNumber] = types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber)}
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *s3ChunkWriter) Complete() error {
+	w.mu.Lock()
+	parts := make([]types.CompletedPart, 0, len(w.completed))
+	for _, p := range w.completed {
+		parts = append(parts, p)
+	}
+	w.mu.Unlock()
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	_, err := w.backend.client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &w.backend.bucket,
+		Key:             &w.key,
+		UploadId:        &w.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (w *s3ChunkWriter) Abort() error {
+	_, err := w.backend.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   &w.backend.bucket,
+		Key:      &w.key,
+		UploadId: &w.uploadID,
+	})
+	return err
+}
+
+func (w *s3ChunkWriter) Token() string { return w.uploadID }
+
+// loadCompletedParts rebuilds completed (and partSize, from part 1's
+// size) from S3's own record of the multipart upload, so resuming after
+// a process restart doesn't forget parts already uploaded.
+func (w *s3ChunkWriter) loadCompletedParts(ctx context.Context) error {
+	out, err := w.backend.client.ListParts(ctx, &s3.ListPartsInput{
+		Bucket:   &w.backend.bucket,
+		Key:      &w.key,
+		UploadId: &w.uploadID,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.completed = make(map[int32]types.CompletedPart, len(out.Parts))
+	for _, p := range out.Parts {
+		if p.PartNumber == nil {
+			continue
+		}
+		w.completed[*p.PartNumber] = types.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber}
+		if w.partSize == 0 && *p.PartNumber == 1 && p.Size != nil {
+			w.partSize = *p.Size
+		}
+	}
+	return nil
+}
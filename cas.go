@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"lukechampine.com/blake3"
+)
+
+// Content-defined chunking parameters (FastCDC-style, gear hash based).
+const (
+	cdcMinChunkSize = 256 * 1024
+	cdcAvgChunkSize = 1 << 20
+	cdcMaxChunkSize = 4 * 1 << 20
+	// cdcMask is sized so that, on average, one in cdcAvgChunkSize byte
+	// boundaries satisfies `hash&mask == 0`.
+	cdcMask = cdcAvgChunkSize - 1
+
+	manifestExt = ".ezmanifest"
+
+	// gcGracePeriod excludes recently-written blobs from handleGC's
+	// sweep: writeDedupedFile stores a file's chunks before writing the
+	// manifest that references them, so a GC sweep running in that
+	// window would see the new chunks as unreferenced and delete them
+	// out from under the in-progress upload.
+	gcGracePeriod = 10 * time.Minute
+)
+
+// casDir returns the root of the content-addressed blob store for baseDir.
+func casDir(baseDir string) string {
+	return filepath.Join(baseDir, ".ezdrop", "cas")
+}
+
+// chunkRef is one chunk entry in a manifest.
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// manifest describes a logical file stored as content-defined chunks.
+type manifest struct {
+	Name   string     `json:"name"`
+	Size   int64      `json:"size"`
+	Mime   string     `json:"mime"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+func isManifestPath(path string) bool {
+	return strings.HasSuffix(path, manifestExt)
+}
+
+func manifestPathFor(targetPath string) string {
+	return targetPath + manifestExt
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *manifest) write(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// gearTable is a fixed pseudo-random table used by the gear rolling hash.
+// Generated once from blake3 so the chunker has no external dependency
+// beyond the hash package already required for chunk addressing.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := blake3.Sum512([]byte("ezdrop-cdc-gear-table"))
+	for i := 0; i < 256; i++ {
+		h := blake3.Sum512(append(seed[:], byte(i)))
+		for j := 0; j < 8; j++ {
+			table[i] = table[i]<<8 | uint64(h[j])
+		}
+	}
+	return table
+}()
+
+// cdcSplit reads all of r and returns the byte boundaries of each
+// content-defined chunk using a FastCDC-style gear hash: a chunk ends
+// as soon as it has reached cdcMinChunkSize and either the rolling hash
+// hits the cut mask or cdcMaxChunkSize is reached.
+func cdcSplit(r io.Reader) ([][]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks [][]byte
+	start := 0
+	var hash uint64
+	for i := 0; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		size := i - start + 1
+		if size < cdcMinChunkSize {
+			continue
+		}
+		if size >= cdcMaxChunkSize || (hash&cdcMask) == 0 {
+			chunks = append(chunks, data[start:i+1])
+			start = i + 1
+			hash = 0
+		}
+	}
+	if start < len(data) {
+		chunks = append(chunks, data[start:])
+	}
+	return chunks, nil
+}
+
+// storeChunk writes data under <casDir>/<hh>/<hash> if it isn't already
+// present, returning its BLAKE3 hex hash.
+func storeChunk(casRoot string, data []byte) (string, error) {
+	sum := blake3.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	dir := filepath.Join(casRoot, hash[:2])
+	path := filepath.Join(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, path)
+}
+
+func chunkPath(casRoot, hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(casRoot, hash)
+	}
+	return filepath.Join(casRoot, hash[:2], hash)
+}
+
+// writeDedupedFile content-defined-chunks src, storing each unique chunk
+// in casRoot and writing a manifest to manifestPath describing how to
+// reassemble the original file.
+func writeDedupedFile(src io.Reader, casRoot, manifestPath, name string) (int64, error) {
+	chunks, err := cdcSplit(src)
+	if err != nil {
+		return 0, err
+	}
+
+	m := &manifest{
+		Name: name,
+		Mime: mime.TypeByExtension(filepath.Ext(name)),
+	}
+	for _, c := range chunks {
+		hash, err := storeChunk(casRoot, c)
+		if err != nil {
+			return 0, err
+		}
+		m.Chunks = append(m.Chunks, chunkRef{Hash: hash, Size: int64(len(c))})
+		m.Size += int64(len(c))
+	}
+
+	if err := m.write(manifestPath); err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+// manifestReader reassembles a manifest's chunks into a single
+// io.ReaderAt, reading each referenced chunk in order; manifestReadSeeker
+// wraps it to add Read and Seek.
+type manifestReader struct {
+	casRoot string
+	chunks  []chunkRef
+	offsets []int64 // offsets[i] = start offset of chunks[i]
+	size    int64
+}
+
+func newManifestReader(casRoot string, m *manifest) *manifestReader {
+	mr := &manifestReader{casRoot: casRoot, chunks: m.Chunks}
+	var off int64
+	for _, c := range m.Chunks {
+		mr.offsets = append(mr.offsets, off)
+		off += c.Size
+	}
+	mr.size = off
+	return mr
+}
+
+func (mr *manifestReader) Size() int64 { return mr.size }
+
+// ReadAt implements io.ReaderAt by locating the chunk(s) covering [off,
+// off+len(p)) and reading the overlapping bytes out of each.
+func (mr *manifestReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= mr.size {
+		return 0, io.EOF
+	}
+
+	idx := searchChunkIndex(mr.offsets, off)
+	read := 0
+	for idx < len(mr.chunks) && read < len(p) {
+		chunkStart := mr.offsets[idx]
+		chunkSize := mr.chunks[idx].Size
+		chunkOff := off + int64(read) - chunkStart
+		if chunkOff < 0 || chunkOff >= chunkSize {
+			break
+		}
+
+		f, err := os.Open(chunkPath(mr.casRoot, mr.chunks[idx].Hash))
+		if err != nil {
+			return read, err
+		}
+		n, err := f.ReadAt(p[read:minInt(len(p), read+int(chunkSize-chunkOff))], chunkOff)
+		f.Close()
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		idx++
+	}
+
+	var err error
+	if read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// searchChunkIndex returns the index of the chunk containing byte offset
+// off, given offsets holding each chunk's start offset in ascending order.
+func searchChunkIndex(offsets []int64, off int64) int {
+	lo, hi := 0, len(offsets)-1
+	idx := 0
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if offsets[mid] <= off {
+			idx = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return idx
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// manifestReadSeeker adapts a manifestReader into an io.ReadSeeker so it
+// can be handed to http.ServeContent, which gives us Range/conditional
+// request handling for deduped downloads for free.
+type manifestReadSeeker struct {
+	mr  *manifestReader
+	pos int64
+}
+
+func (s *manifestReadSeeker) Read(p []byte) (int, error) {
+	if s.pos >= s.mr.size {
+		return 0, io.EOF
+	}
+	n, err := s.mr.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *manifestReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = s.pos + offset
+	case io.SeekEnd:
+		newPos = s.mr.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("negative seek position")
+	}
+	s.pos = newPos
+	return s.pos, nil
+}
+
+// serveManifest streams a deduped file's content straight from its CAS
+// chunks, reassembled transparently, with Range support via ServeContent.
+func serveManifest(w http.ResponseWriter, r *http.Request, m *manifest, casRoot, name string) {
+	rs := &manifestReadSeeker{mr: newManifestReader(casRoot, m)}
+	http.ServeContent(w, r, name, time.Time{}, rs)
+}
+
+// handleGC sweeps casDir for blobs no longer referenced by any manifest
+// under baseDir and removes them.
+func handleGC(baseDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		casRoot := casDir(baseDir)
+		referenced := make(map[string]bool)
+
+		err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !isManifestPath(path) {
+				return nil
+			}
+			m, err := readManifest(path)
+			if err != nil {
+				return nil
+			}
+			for _, c := range m.Chunks {
+				referenced[c.Hash] = true
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var removed int
+		now := time.Now()
+		_ = filepath.Walk(casRoot, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if now.Sub(info.ModTime()) < gcGracePeriod {
+				return nil
+			}
+			hash := filepath.Base(path)
+			if !referenced[hash] {
+				if err := os.Remove(path); err == nil {
+					removed++
+				}
+			}
+			return nil
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"removedChunks": removed,
+		})
+	}
+}
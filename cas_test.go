@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCdcSplit(t *testing.T) {
+	t.Run("empty input", func(t *testing.T) {
+		chunks, err := cdcSplit(bytes.NewReader(nil))
+		if err != nil {
+			t.Fatalf("cdcSplit: %v", err)
+		}
+		if len(chunks) != 0 {
+			t.Fatalf("got %d chunks, want 0", len(chunks))
+		}
+	})
+
+	t.Run("reassembles to the original bytes", func(t *testing.T) {
+		data := make([]byte, 8*cdcAvgChunkSize)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatalf("rand.Read: %v", err)
+		}
+
+		chunks, err := cdcSplit(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("cdcSplit: %v", err)
+		}
+
+		var got []byte
+		for _, c := range chunks {
+			if len(c) > cdcMaxChunkSize {
+				t.Fatalf("chunk of size %d exceeds cdcMaxChunkSize", len(c))
+			}
+			got = append(got, c...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("reassembled data does not match input")
+		}
+	})
+
+	t.Run("small input under min chunk size is a single chunk", func(t *testing.T) {
+		data := []byte("hello world")
+		chunks, err := cdcSplit(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("cdcSplit: %v", err)
+		}
+		if len(chunks) != 1 || !bytes.Equal(chunks[0], data) {
+			t.Fatalf("got %v, want a single chunk equal to input", chunks)
+		}
+	})
+}
+
+func TestSearchChunkIndex(t *testing.T) {
+	offsets := []int64{0, 100, 250, 400}
+
+	cases := []struct {
+		off  int64
+		want int
+	}{
+		{0, 0},
+		{50, 0},
+		{100, 1},
+		{249, 1},
+		{250, 2},
+		{399, 2},
+		{400, 3},
+		{1000, 3},
+	}
+
+	for _, tc := range cases {
+		if got := searchChunkIndex(offsets, tc.off); got != tc.want {
+			t.Errorf("searchChunkIndex(%v, %d) = %d, want %d", offsets, tc.off, got, tc.want)
+		}
+	}
+}
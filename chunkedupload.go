@@ -0,0 +1,545 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+)
+
+// errChunkHashMismatch is returned by WriteChunk when the caller-supplied
+// X-Chunk-Hash doesn't match the chunk actually received, so the caller
+// knows to request a retransmit rather than treat it as a fatal error.
+var errChunkHashMismatch = errors.New("chunk hash mismatch")
+
+// byteRange is a half-open [Start, End) span of bytes already received.
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// chunkUploadMeta is the sidecar describing an in-progress upload (its
+// destination and dedupe settings), persisted next to the upload's
+// bookkeeping state so a resumed upload or the status endpoint can be
+// served without any in-memory state.
+type chunkUploadMeta struct {
+	FileName   string `json:"fileName"`
+	RelPath    string `json:"relPath"`
+	TargetPath string `json:"targetPath"`
+	TotalSize  int64  `json:"totalSize"`
+	Dedupe     bool   `json:"dedupe"`
+	CasRoot    string `json:"casRoot"`
+	// BackendToken is the backend's opaque resume handle for the
+	// in-progress write (an S3 multipart upload ID; empty for the local
+	// backend), so a later request for the same upload ID can resume the
+	// same backend-side write instead of starting a new one.
+	BackendToken string `json:"backendToken,omitempty"`
+}
+
+// uploadLocks serializes all requests for a given upload ID, since each
+// one reconstructs its own *ChunkedUpload and its mu only guards that
+// one instance: without a lock shared across requests, two concurrent
+// chunk POSTs for the same upload ID can load-modify-save upload.ranges
+// independently and silently clobber each other's recorded range.
+var uploadLocks sync.Map // map[string]*sync.Mutex
+
+// lockUpload acquires the lock for uploadID, creating it on first use,
+// and returns a function that releases it.
+func lockUpload(uploadID string) func() {
+	v, _ := uploadLocks.LoadOrStore(uploadID, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// ChunkedUpload writes incoming chunks directly at their offset, tracking
+// which byte ranges have arrived in a merged, sorted list persisted as a
+// ".ranges" sidecar so a resumed upload can report exactly what's
+// missing. Plain uploads write through backend.OpenChunkWriter, so an S3
+// backend relays them straight onto S3 multipart UploadPart calls with no
+// local spool; dedupe mode always writes to a local ".part" file under
+// StateDir first, since content-defined chunking into the CAS is a
+// local-disk-only feature (see cas.go).
+type ChunkedUpload struct {
+	FileName     string
+	RelPath      string // path relative to backend root, used for non-dedupe writes
+	TargetPath   string // absolute local path, used only in dedupe mode
+	TotalSize    int64
+	StateDir     string
+	LastActivity time.Time
+	Dedupe       bool
+	CasRoot      string
+	BackendToken string // backend resume handle; see chunkUploadMeta.BackendToken
+
+	backend Backend
+
+	mu     sync.Mutex
+	ranges []byteRange
+	cw     ChunkWriter
+}
+
+func (u *ChunkedUpload) partPath() string   { return filepath.Join(u.StateDir, "upload.part") }
+func (u *ChunkedUpload) rangesPath() string { return filepath.Join(u.StateDir, "upload.ranges") }
+func (u *ChunkedUpload) metaPath() string   { return filepath.Join(u.StateDir, "upload.meta") }
+
+// uploadStateDir derives a filesystem-safe state directory from an
+// upload ID, so filenames containing path separators or other awkward
+// characters can't escape chunkDir.
+func uploadStateDir(chunkDir, uploadID string) string {
+	sum := sha256.Sum256([]byte(uploadID))
+	return filepath.Join(chunkDir, hex.EncodeToString(sum[:]))
+}
+
+// NewChunkedUpload creates (or resumes) the upload state rooted at
+// stateDir. stateDir is expected to be derived deterministically from the
+// upload ID via uploadStateDir, so a later request for the same ID finds
+// the same range list, even across a server restart. relPath is the
+// destination relative to backend's root; targetPath is its absolute
+// local equivalent, used only when dedupe is true.
+func NewChunkedUpload(backend Backend, fileName, relPath, targetPath, stateDir string, totalSize int64, dedupe bool, casRoot string) (*ChunkedUpload, error) {
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	u := &ChunkedUpload{
+		FileName:     fileName,
+		RelPath:      relPath,
+		TargetPath:   targetPath,
+		TotalSize:    totalSize,
+		StateDir:     stateDir,
+		LastActivity: time.Now(),
+		Dedupe:       dedupe,
+		CasRoot:      casRoot,
+		backend:      backend,
+	}
+
+	ranges, err := loadChunkRanges(stateDir)
+	if err == nil {
+		// Resuming an upload a prior request already started: pick up
+		// its backend resume token (if any) rather than re-initializing,
+		// so a fresh process doesn't start a second backend-side write
+		// for the same upload.
+		u.ranges = ranges
+		if meta, err := loadChunkUploadMeta(stateDir); err == nil {
+			u.BackendToken = meta.BackendToken
+		}
+		return u, nil
+	}
+
+	// Brand new upload: initialize its writer exactly once, then persist
+	// the resulting state (including any backend resume token).
+	u.ranges = []byteRange{}
+	if err := u.initWriter(totalSize); err != nil {
+		return nil, err
+	}
+	if err := u.saveMeta(); err != nil {
+		return nil, err
+	}
+	if err := u.saveRanges(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// initWriter prepares the on-disk/remote state for a brand new upload.
+func (u *ChunkedUpload) initWriter(totalSize int64) error {
+	if u.Dedupe {
+		f, err := os.Create(u.partPath())
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(totalSize); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return u.openWriter()
+}
+
+// openWriter (re)acquires the ChunkWriter used for non-dedupe writes,
+// resuming the backend's in-progress write via BackendToken if this
+// isn't the first request for the upload (each chunk POST reconstructs
+// its own ChunkedUpload, so this may run many times over an upload's
+// life). For the S3 backend this reuses the existing multipart upload
+// ID instead of starting a new one.
+func (u *ChunkedUpload) openWriter() error {
+	if u.Dedupe {
+		return nil
+	}
+	cw, err := u.backend.OpenChunkWriter(u.RelPath, u.TotalSize, u.BackendToken)
+	if err != nil {
+		return err
+	}
+	u.cw = cw
+	u.BackendToken = cw.Token()
+	return nil
+}
+
+// loadChunkRanges reads just the range list from stateDir's sidecar, used
+// both to resume an in-memory upload and to answer the status endpoint
+// without one.
+func loadChunkRanges(stateDir string) ([]byteRange, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, "upload.ranges"))
+	if err != nil {
+		return nil, err
+	}
+	var ranges []byteRange
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+func loadChunkUploadMeta(stateDir string) (*chunkUploadMeta, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, "upload.meta"))
+	if err != nil {
+		return nil, err
+	}
+	var meta chunkUploadMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (u *ChunkedUpload) saveMeta() error {
+	meta := chunkUploadMeta{
+		FileName:     u.FileName,
+		RelPath:      u.RelPath,
+		TargetPath:   u.TargetPath,
+		TotalSize:    u.TotalSize,
+		Dedupe:       u.Dedupe,
+		CasRoot:      u.CasRoot,
+		BackendToken: u.BackendToken,
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.metaPath(), data, 0o644)
+}
+
+func (u *ChunkedUpload) saveRanges() error {
+	data, err := json.Marshal(u.ranges)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.rangesPath(), data, 0o644)
+}
+
+// insertRange merges [start, end) into ranges, keeping the list sorted
+// and coalescing overlapping or adjacent spans.
+func insertRange(ranges []byteRange, start, end int64) []byteRange {
+	ranges = append(ranges, byteRange{Start: start, End: end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// missingRanges returns the gaps in [0, totalSize) not yet covered by ranges.
+func missingRanges(ranges []byteRange, totalSize int64) []byteRange {
+	missing := []byteRange{}
+	cursor := int64(0)
+	for _, r := range ranges {
+		if r.Start > cursor {
+			missing = append(missing, byteRange{Start: cursor, End: r.Start})
+		}
+		if r.End > cursor {
+			cursor = r.End
+		}
+	}
+	if cursor < totalSize {
+		missing = append(missing, byteRange{Start: cursor, End: totalSize})
+	}
+	return missing
+}
+
+// WriteChunk writes data at offset: into the local ".part" file in
+// dedupe mode, or straight through the backend's ChunkWriter otherwise
+// (an UploadPart call for the S3 backend). If expectedHash is non-empty,
+// it must match the SHA-256 of data or the chunk is rejected with
+// errChunkHashMismatch and nothing is written, so the caller can request
+// a retransmit instead of failing the upload.
+func (u *ChunkedUpload) WriteChunk(offset int64, data []byte, expectedHash string) error {
+	if expectedHash != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != expectedHash {
+			return errChunkHashMismatch
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Dedupe {
+		f, err := os.OpenFile(u.partPath(), os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return err
+		}
+	} else {
+		if u.cw == nil {
+			if err := u.openWriter(); err != nil {
+				return err
+			}
+		}
+		if err := u.cw.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+
+	u.ranges = insertRange(u.ranges, offset, offset+int64(len(data)))
+	u.LastActivity = time.Now()
+	return u.saveRanges()
+}
+
+// IsComplete reports whether the received ranges cover [0, TotalSize) as
+// a single interval.
+func (u *ChunkedUpload) IsComplete() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.ranges) == 1 && u.ranges[0].Start == 0 && u.ranges[0].End >= u.TotalSize
+}
+
+// Received returns the total number of bytes received so far.
+func (u *ChunkedUpload) Received() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var total int64
+	for _, r := range u.ranges {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// MissingRanges returns the byte ranges still needed to complete the upload.
+func (u *ChunkedUpload) MissingRanges() []byteRange {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return missingRanges(u.ranges, u.TotalSize)
+}
+
+// Finalize completes the upload: in dedupe mode it content-defined-chunks
+// the local part file straight into the CAS; otherwise it calls the
+// backend ChunkWriter's Complete (an fsync+rename for the local backend,
+// a CompleteMultipartUpload for S3). Either way it then removes the
+// upload's bookkeeping state.
+func (u *ChunkedUpload) Finalize() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Dedupe {
+		src, err := os.Open(u.partPath())
+		if err != nil {
+			return err
+		}
+		_, err = writeDedupedFile(src, u.CasRoot, manifestPathFor(u.TargetPath), u.FileName)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		return u.Cleanup()
+	}
+
+	if err := u.cw.Complete(); err != nil {
+		return err
+	}
+	return u.Cleanup()
+}
+
+// Cleanup removes all on-disk bookkeeping state for this upload (the
+// uploaded content itself is untouched).
+func (u *ChunkedUpload) Cleanup() error {
+	return os.RemoveAll(u.StateDir)
+}
+
+// handleChunkUpload accepts chunks addressed by byte offset (see
+// ChunkInfo) and writes each through backend (or, in dedupe mode, into a
+// local CAS-bound part file). Upload bookkeeping lives entirely under
+// chunkDir as upload.ranges/.meta keyed by uploadStateDir(uploadID), so
+// it survives a server restart and can be inspected by handleChunkStatus
+// without any in-memory lookup.
+func handleChunkUpload(backend Backend, baseDir, chunkDir string, dedupe bool, hub *Hub) http.HandlerFunc {
+	go chunkUploadExpirySweep(chunkDir)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		relDir := r.URL.Query().Get("dir")
+		targetDir := baseDir
+		if relDir != "" {
+			targetDir = filepath.Join(baseDir, relDir)
+		}
+		absTargetDir, err := filepath.Abs(targetDir)
+		if err != nil || !strings.HasPrefix(absTargetDir, baseDir) {
+			http.Error(w, "Invalid directory", http.StatusBadRequest)
+			return
+		}
+
+		var chunkInfo ChunkInfo
+		if err := json.NewDecoder(r.Body).Decode(&chunkInfo); err != nil {
+			http.Error(w, "Invalid chunk info", http.StatusBadRequest)
+			return
+		}
+		if chunkInfo.Offset < 0 || chunkInfo.ChunkSize < 0 || chunkInfo.Offset+chunkInfo.ChunkSize > chunkInfo.TotalSize {
+			http.Error(w, "Invalid chunk offset or size", http.StatusBadRequest)
+			return
+		}
+
+		uploadID := fmt.Sprintf("%s_%d", chunkInfo.FileName, chunkInfo.TotalSize)
+
+		// Two chunk POSTs for the same upload ID must not load, modify,
+		// and save upload.ranges concurrently, so serialize the whole
+		// request (construction through finalize) per upload ID.
+		unlock := lockUpload(uploadID)
+		defer unlock()
+
+		stateDir := uploadStateDir(chunkDir, uploadID)
+		relPath := filepath.Join(relDir, chunkInfo.FileName)
+		targetPath := filepath.Join(absTargetDir, chunkInfo.FileName)
+
+		upload, err := NewChunkedUpload(backend, chunkInfo.FileName, relPath, targetPath, stateDir, chunkInfo.TotalSize, dedupe, casDir(baseDir))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to start upload: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		chunk := make([]byte, chunkInfo.ChunkSize)
+		if _, err := io.ReadFull(r.Body, chunk); err != nil {
+			http.Error(w, "Error reading chunk data", http.StatusBadRequest)
+			return
+		}
+
+		if err := upload.WriteChunk(chunkInfo.Offset, chunk, r.Header.Get("X-Chunk-Hash")); err != nil {
+			if errors.Is(err, errChunkHashMismatch) {
+				http.Error(w, "Chunk hash mismatch, please retransmit", http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error writing chunk: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		hub.BroadcastProgress(relDir, chunkInfo.FileName, upload.Received(), chunkInfo.TotalSize, 0)
+
+		if upload.IsComplete() {
+			if err := upload.Finalize(); err != nil {
+				http.Error(w, fmt.Sprintf("Error finalizing upload: %v", err), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Completed chunked upload: %s", chunkInfo.FileName)
+			hub.BroadcastFSChange("created", filepath.Join(relDir, chunkInfo.FileName), relDir)
+			uploadLocks.Delete(uploadID)
+		}
+
+		w.Header().Set("X-Upload-Id", uploadID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// chunkStatusResponse is the JSON body returned by handleChunkStatus.
+type chunkStatusResponse struct {
+	TotalSize int64       `json:"totalSize"`
+	Received  int64       `json:"received"`
+	Missing   []byteRange `json:"missing"`
+}
+
+// handleChunkStatus reports which byte ranges a resumed upload still
+// needs, so the client can skip re-sending data it already delivered.
+func handleChunkStatus(chunkDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uploadID, err := url.QueryUnescape(r.URL.Query().Get("id"))
+		if err != nil || uploadID == "" {
+			http.Error(w, "Missing id parameter", http.StatusBadRequest)
+			return
+		}
+
+		stateDir := uploadStateDir(chunkDir, uploadID)
+		meta, err := loadChunkUploadMeta(stateDir)
+		if err != nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+		ranges, err := loadChunkRanges(stateDir)
+		if err != nil {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		}
+
+		var received int64
+		for _, rg := range ranges {
+			received += rg.End - rg.Start
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chunkStatusResponse{
+			TotalSize: meta.TotalSize,
+			Received:  received,
+			Missing:   missingRanges(ranges, meta.TotalSize),
+		})
+	}
+}
+
+// chunkUploadExpirySweep periodically removes abandoned upload bookkeeping
+// state, mirroring tusExpirySweep's disk-only cleanup so there's no
+// in-memory state to leak across a server restart. It does not abort any
+// in-progress S3 multipart upload; an idle one expires on its own per the
+// bucket's lifecycle configuration.
+func chunkUploadExpirySweep(chunkDir string) {
+	const abandonedAfter = 10 * time.Minute
+	for {
+		time.Sleep(time.Minute)
+		entries, err := os.ReadDir(chunkDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			stateDir := filepath.Join(chunkDir, entry.Name())
+			info, err := os.Stat(filepath.Join(stateDir, "upload.ranges"))
+			if err != nil {
+				continue
+			}
+			if time.Since(info.ModTime()) > abandonedAfter {
+				os.RemoveAll(stateDir)
+				log.Printf("Cleaned up abandoned chunked upload: %s", entry.Name())
+			}
+		}
+	}
+}
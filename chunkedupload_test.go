@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInsertRange(t *testing.T) {
+	cases := []struct {
+		name   string
+		ranges []byteRange
+		start  int64
+		end    int64
+		want   []byteRange
+	}{
+		{"into empty", nil, 0, 10, []byteRange{{0, 10}}},
+		{"disjoint after", []byteRange{{0, 10}}, 20, 30, []byteRange{{0, 10}, {20, 30}}},
+		{"disjoint before", []byteRange{{20, 30}}, 0, 10, []byteRange{{0, 10}, {20, 30}}},
+		{"overlapping", []byteRange{{0, 10}}, 5, 20, []byteRange{{0, 20}}},
+		{"adjacent merges", []byteRange{{0, 10}}, 10, 20, []byteRange{{0, 20}}},
+		{"fills gap between two", []byteRange{{0, 10}, {20, 30}}, 10, 20, []byteRange{{0, 30}}},
+		{"duplicate", []byteRange{{0, 10}}, 0, 10, []byteRange{{0, 10}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := insertRange(tc.ranges, tc.start, tc.end)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	cases := []struct {
+		name      string
+		ranges    []byteRange
+		totalSize int64
+		want      []byteRange
+	}{
+		{"nothing received", nil, 100, []byteRange{{0, 100}}},
+		{"fully received", []byteRange{{0, 100}}, 100, []byteRange{}},
+		{"gap in middle", []byteRange{{0, 10}, {20, 100}}, 100, []byteRange{{10, 20}}},
+		{"gap at end", []byteRange{{0, 90}}, 100, []byteRange{{90, 100}}},
+		{"gap at start", []byteRange{{10, 100}}, 100, []byteRange{{0, 10}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := missingRanges(tc.ranges, tc.totalSize)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	http "github.com/Noooste/fhttp"
+)
+
+// DownloadConfig tunes the parallel single-file download path.
+type DownloadConfig struct {
+	Concurrency int   // number of goroutines reading a single file in parallel
+	ChunkSize   int64 // size of each range assigned to a worker
+}
+
+// DefaultDownloadConfig mirrors the -download-concurrency/-download-chunk-size
+// flag defaults.
+var DefaultDownloadConfig = DownloadConfig{
+	Concurrency: 4,
+	ChunkSize:   16 << 20,
+}
+
+// segment is one (offset, length) slice of a file read by a single worker.
+type segment struct {
+	index  int
+	offset int64
+	length int64
+}
+
+// parallelResult carries one worker's read-back data tagged with its
+// segment index, so the writer goroutine can re-order them.
+type parallelResult struct {
+	index int
+	data  []byte
+	err   error
+}
+
+var downloadBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, DefaultDownloadConfig.ChunkSize)
+	},
+}
+
+// serveFileParallel serves [offset, offset+length) of path using cfg.Concurrency
+// workers, each opening its own file descriptor and taking cfg.ChunkSize
+// slices, in file order, from a shared queue as it becomes free; a single
+// writer goroutine re-orders the results and streams them to w in sequence.
+func serveFileParallel(w http.ResponseWriter, path string, offset, length int64, cfg DownloadConfig) error {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.ChunkSize < 1 {
+		cfg.ChunkSize = DefaultDownloadConfig.ChunkSize
+	}
+
+	var segments []segment
+	for off, idx := offset, 0; off < offset+length; off, idx = off+cfg.ChunkSize, idx+1 {
+		segLen := cfg.ChunkSize
+		if remaining := offset + length - off; remaining < segLen {
+			segLen = remaining
+		}
+		segments = append(segments, segment{index: idx, offset: off, length: segLen})
+	}
+
+	results := make([]chan parallelResult, len(segments))
+	for i := range results {
+		results[i] = make(chan parallelResult, 1)
+	}
+
+	work := make(chan segment)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := os.Open(path)
+			if err != nil {
+				for seg := range work {
+					results[seg.index] <- parallelResult{index: seg.index, err: err}
+				}
+				return
+			}
+			defer f.Close()
+
+			for seg := range work {
+				buf := downloadBufferPool.Get().([]byte)
+				if int64(len(buf)) < seg.length {
+					buf = make([]byte, seg.length)
+				}
+				buf = buf[:seg.length]
+
+				_, err := f.ReadAt(buf, seg.offset)
+				if err != nil && err != io.EOF {
+					results[seg.index] <- parallelResult{index: seg.index, err: err}
+					continue
+				}
+				results[seg.index] <- parallelResult{index: seg.index, data: buf}
+			}
+		}()
+	}
+
+	go func() {
+		for _, seg := range segments {
+			work <- seg
+		}
+		close(work)
+	}()
+
+	var firstErr error
+	for _, ch := range results {
+		res := <-ch
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		if firstErr == nil {
+			if _, err := w.Write(res.data); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		downloadBufferPool.Put(res.data[:cap(res.data)])
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// handleParallelDownload is the ?parallel=N path for a single file: it
+// honors an optional Range header (single, suffix, or multi-range) for the
+// requested slice(s), and streams the whole file or a single range via
+// serveFileParallel, advertising Accept-Ranges on those responses. A
+// multi-range request gets a real multipart/byteranges response from
+// serveMultiRange (without an Accept-Ranges header) rather than being
+// silently served as a single range or the whole file. fileName sets
+// Content-Disposition the
+// same way the plain (non-ranged) download path does, so resuming a
+// download or seeking a video doesn't lose the attachment filename hint.
+func handleParallelDownload(w http.ResponseWriter, r *http.Request, filePath, fileName string, cfg DownloadConfig) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if n, err := strconv.Atoi(r.URL.Query().Get("parallel")); err == nil && n > 0 {
+		cfg.Concurrency = n
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		if err := serveFileParallel(w, filePath, 0, info.Size(), cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	ranges, ok := parseRanges(rangeHeader, info.Size())
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+		http.Error(w, "Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if len(ranges) > 1 {
+		serveMultiRange(w, filePath, fileName, ranges, info.Size())
+		return
+	}
+
+	offset, length := ranges[0].Start, ranges[0].End-ranges[0].Start
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size()))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if err := serveFileParallel(w, filePath, offset, length, cfg); err != nil {
+		// Headers are already flushed by this point, so the status can no
+		// longer be changed to a 500; just log the error.
+		log.Printf("Error serving range of %s: %v", filePath, err)
+	}
+}
+
+// parseRanges parses a "bytes=..." Range header into one or more
+// half-open byte ranges, honoring suffix ranges ("bytes=-500") and
+// comma-separated multi-range requests. It reports ok=false for a
+// malformed header or a range wholly outside [0, size), mirroring
+// http.ServeContent's handling of an unsatisfiable range.
+func parseRanges(header string, size int64) ([]byteRange, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			return nil, false
+		}
+
+		var start, end int64
+		switch {
+		case strings.HasPrefix(spec, "-"):
+			var suffix int64
+			if _, err := fmt.Sscanf(spec, "-%d", &suffix); err != nil {
+				return nil, false
+			}
+			if suffix > size {
+				suffix = size
+			}
+			start, end = size-suffix, size-1
+		default:
+			if _, err := fmt.Sscanf(spec, "%d-%d", &start, &end); err == nil {
+				if end >= size {
+					end = size - 1
+				}
+			} else if _, err := fmt.Sscanf(spec, "%d-", &start); err == nil {
+				end = size - 1
+			} else {
+				return nil, false
+			}
+		}
+
+		if start < 0 || end < start || start >= size {
+			return nil, false
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, false
+	}
+	return ranges, true
+}
+
+// serveMultiRange writes a multipart/byteranges response (RFC 7233 §4.1)
+// for a Range header naming more than one range. Parts are read and
+// written sequentially rather than through serveFileParallel's worker
+// pool, since interleaving concurrent reads across parts would gain
+// little for the typically-small ranges multi-range requests ask for.
+// fileName sets Content-Disposition, same as the other download paths.
+func serveMultiRange(w http.ResponseWriter, path, fileName string, ranges []byteRange, size int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	boundaryBytes := make([]byte, 16)
+	if _, err := rand.Read(boundaryBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	boundary := hex.EncodeToString(boundaryBytes)
+
+	contentType := mime.FormatMediaType("multipart/byteranges", map[string]string{"boundary": boundary})
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, rg := range ranges {
+		fmt.Fprintf(w, "--%s\r\nContent-Range: bytes %d-%d/%d\r\n\r\n", boundary, rg.Start, rg.End-1, size)
+		if _, err := io.Copy(w, io.NewSectionReader(f, rg.Start, rg.End-rg.Start)); err != nil {
+			return
+		}
+		fmt.Fprint(w, "\r\n")
+	}
+	fmt.Fprintf(w, "--%s--\r\n", boundary)
+}
+
+// zipEntry is one file queued for parallel compression into the final zip.
+type zipEntry struct {
+	relPath string
+	open    func() (io.ReadCloser, int64, error)
+}
+
+// zipEntryResult is a fully-compressed entry ready to be written to the
+// archive via zip.Writer.CreateRaw, preserving deterministic ordering.
+type zipEntryResult struct {
+	header     *zip.FileHeader
+	compressed []byte
+	err        error
+}
+
+// writeZipParallel compresses entries concurrently (bounded by a worker
+// pool sized to the host's CPU count) but writes them into zw strictly in
+// entries order, since zip.Writer itself is not safe for concurrent use.
+func writeZipParallel(zw *zip.Writer, entries []zipEntry) error {
+	workers := runtime.NumCPU()
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]chan zipEntryResult, len(entries))
+	for i := range results {
+		results[i] = make(chan zipEntryResult, 1)
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, entry zipEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] <- compressZipEntry(entry)
+		}(i, entry)
+	}
+
+	for _, ch := range results {
+		res := <-ch
+		if res.err != nil {
+			wg.Wait()
+			return res.err
+		}
+		dst, err := zw.CreateRaw(res.header)
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		if _, err := dst.Write(res.compressed); err != nil {
+			wg.Wait()
+			return err
+		}
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func compressZipEntry(entry zipEntry) zipEntryResult {
+	src, size, err := entry.open()
+	if err != nil {
+		return zipEntryResult{err: err}
+	}
+	defer src.Close()
+
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return zipEntryResult{err: err}
+	}
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return zipEntryResult{err: err}
+	}
+	if _, err := fw.Write(raw); err != nil {
+		return zipEntryResult{err: err}
+	}
+	if err := fw.Close(); err != nil {
+		return zipEntryResult{err: err}
+	}
+
+	header := &zip.FileHeader{
+		Name:               entry.relPath,
+		Method:             zip.Deflate,
+		UncompressedSize64: uint64(size),
+		CRC32:              crc32.ChecksumIEEE(raw),
+	}
+	header.CompressedSize64 = uint64(buf.Len())
+
+	return zipEntryResult{header: header, compressed: buf.Bytes()}
+}
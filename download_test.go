@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseRanges(t *testing.T) {
+	const size = 1000
+
+	cases := []struct {
+		name   string
+		header string
+		want   []byteRange
+		ok     bool
+	}{
+		{"simple", "bytes=0-499", []byteRange{{0, 500}}, true},
+		{"open ended", "bytes=500-", []byteRange{{500, 1000}}, true},
+		{"clamped end", "bytes=900-1999", []byteRange{{900, 1000}}, true},
+		{"suffix", "bytes=-200", []byteRange{{800, 1000}}, true},
+		{"suffix longer than size", "bytes=-5000", []byteRange{{0, 1000}}, true},
+		{"multi range", "bytes=0-99,200-299", []byteRange{{0, 100}, {200, 300}}, true},
+		{"missing prefix", "0-499", nil, false},
+		{"start past size", "bytes=1000-1099", nil, false},
+		{"start after end", "bytes=500-100", nil, false},
+		{"empty spec", "bytes=", nil, false},
+		{"malformed", "bytes=abc", nil, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseRanges(tc.header, size)
+			if ok != tc.ok {
+				t.Fatalf("ok = %v, want %v", ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("range %d: got %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
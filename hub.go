@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = wsPingInterval + 10*time.Second
+	wsWriteWait    = 10 * time.Second
+
+	progressReportInterval = 250 * time.Millisecond
+)
+
+// UploadProgress is broadcast on the hub while a file is being received.
+type UploadProgress struct {
+	Type          string  `json:"type"`
+	FileName      string  `json:"fileName"`
+	BytesReceived int64   `json:"bytesReceived"`
+	TotalSize     int64   `json:"totalSize"`
+	Speed         float64 `json:"speed"` // bytes/sec
+}
+
+// FSChangeEvent is broadcast whenever a file is created, renamed or
+// deleted, so other tabs can refresh without polling /api/list.
+type FSChangeEvent struct {
+	Type  string `json:"type"`
+	Event string `json:"event"` // "created", "renamed", "deleted"
+	Path  string `json:"path"`
+	Dir   string `json:"dir"`
+}
+
+type subscribeMessage struct {
+	Type string `json:"type"`
+	Dir  string `json:"dir"`
+}
+
+// Client is a single connected WebSocket session.
+type Client struct {
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+
+	mu   sync.RWMutex
+	dirs map[string]bool // dirs this client is subscribed to; empty = all
+}
+
+func (c *Client) subscribed(dir string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.dirs) == 0 {
+		return true
+	}
+	return c.dirs[dir]
+}
+
+func (c *Client) subscribe(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirs[dir] = true
+}
+
+// Hub tracks every connected client and fans broadcasts out to them,
+// filtering both fs_changed and upload_progress events by directory
+// subscription; events for the root dir ("") reach every client.
+type Hub struct {
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan broadcastMessage
+
+	mu      sync.RWMutex
+	clients map[*Client]bool
+}
+
+type broadcastMessage struct {
+	dir  string // "" means deliver to every client regardless of subscription
+	data []byte
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan broadcastMessage, 256),
+		clients:    make(map[*Client]bool),
+	}
+}
+
+// Run processes register/unregister/broadcast events until the process
+// exits; call it once in its own goroutine.
+func (h *Hub) Run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.mu.Lock()
+			h.clients[c] = true
+			h.mu.Unlock()
+
+		case c := <-h.unregister:
+			h.mu.Lock()
+			if _, ok := h.clients[c]; ok {
+				delete(h.clients, c)
+				close(c.send)
+			}
+			h.mu.Unlock()
+
+		case msg := <-h.broadcast:
+			h.mu.RLock()
+			for c := range h.clients {
+				if msg.dir != "" && !c.subscribed(msg.dir) {
+					continue
+				}
+				select {
+				case c.send <- msg.data:
+				default:
+					// Slow consumer; drop the client rather than block the hub.
+					go h.unregisterClient(c)
+				}
+			}
+			h.mu.RUnlock()
+		}
+	}
+}
+
+func (h *Hub) unregisterClient(c *Client) {
+	h.unregister <- c
+}
+
+func (h *Hub) broadcastJSON(dir string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshaling websocket event: %v", err)
+		return
+	}
+	h.broadcast <- broadcastMessage{dir: dir, data: data}
+}
+
+// BroadcastProgress notifies subscribers of upload progress for a file
+// being written to dir.
+func (h *Hub) BroadcastProgress(dir, fileName string, bytesReceived, totalSize int64, speed float64) {
+	h.broadcastJSON(dir, UploadProgress{
+		Type:          "upload_progress",
+		FileName:      fileName,
+		BytesReceived: bytesReceived,
+		TotalSize:     totalSize,
+		Speed:         speed,
+	})
+}
+
+// BroadcastFSChange notifies subscribers that dir's contents changed.
+func (h *Hub) BroadcastFSChange(event, path, dir string) {
+	h.broadcastJSON(dir, FSChangeEvent{
+		Type:  "fs_changed",
+		Event: event,
+		Path:  path,
+		Dir:   dir,
+	})
+}
+
+// handleWebSocket upgrades the connection, registers it with hub, and
+// pumps subscribe messages in from the client and queued events out to
+// it, with a ping/pong keepalive replacing the old blocking ReadMessage
+// loop.
+func handleWebSocket(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade error: %v", err)
+			return
+		}
+
+		client := &Client{
+			hub:  hub,
+			conn: conn,
+			send: make(chan []byte, 32),
+			dirs: make(map[string]bool),
+		}
+		hub.register <- client
+
+		go client.writePump()
+		client.readPump()
+	}
+}
+
+// readPump consumes subscribe messages and keepalive pongs until the
+// connection errors out, then unregisters the client.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregisterClient(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg subscribeMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Type == "subscribe" {
+			c.subscribe(msg.Dir)
+		}
+	}
+}
+
+// writePump drains queued broadcasts to the socket and sends periodic
+// pings, closing the connection if either fails.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// progressWriter wraps an io.Writer and periodically reports bytes
+// copied through it to hub; handleUpload uses it for live progress.
+// handleChunkUpload and the tus handler do not use it: they call
+// BroadcastProgress directly once per chunk, with a speed of 0.
+type progressWriter struct {
+	w        io.Writer
+	hub      *Hub
+	dir      string
+	fileName string
+	total    int64
+
+	written        int64
+	lastReportAt   time.Time
+	lastReportSize int64
+}
+
+func newProgressWriter(w io.Writer, hub *Hub, dir, fileName string, total int64) *progressWriter {
+	return &progressWriter{w: w, hub: hub, dir: dir, fileName: fileName, total: total, lastReportAt: time.Now()}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+
+	if elapsed := time.Since(pw.lastReportAt); elapsed >= progressReportInterval || pw.written >= pw.total {
+		speed := float64(pw.written-pw.lastReportSize) / elapsed.Seconds()
+		pw.hub.BroadcastProgress(pw.dir, pw.fileName, pw.written, pw.total, speed)
+		pw.lastReportAt = time.Now()
+		pw.lastReportSize = pw.written
+	}
+
+	return n, err
+}
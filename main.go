@@ -12,7 +12,6 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
 	"text/template"
 	"time"
 
@@ -39,12 +38,14 @@ type FileInfo struct {
 	ModTime string `json:"modTime"`
 }
 
+// ChunkInfo precedes each chunk's raw bytes in a POST /api/upload/chunk
+// body, addressing the chunk by byte offset rather than index so it can
+// be written straight into its place in the sparse target file.
 type ChunkInfo struct {
-	FileName    string `json:"fileName"`
-	ChunkIndex  int    `json:"chunkIndex"`
-	TotalChunks int    `json:"totalChunks"`
-	ChunkSize   int64  `json:"chunkSize"`
-	TotalSize   int64  `json:"totalSize"`
+	FileName  string `json:"fileName"`
+	Offset    int64  `json:"offset"`
+	ChunkSize int64  `json:"chunkSize"`
+	TotalSize int64  `json:"totalSize"`
 }
 
 func main() {
@@ -53,6 +54,18 @@ func main() {
 		chrootDir = flag.String("chroot", "", "Base directory to serve (required)")
 		port      = flag.String("port", "8080", "Port to listen on (optional, default: 8080)")
 		readOnly  = flag.Bool("readonly", false, "Enable read-only mode (optional, default: false)")
+		tusDir    = flag.String("tus-dir", filepath.Join(os.TempDir(), "ezdrop-tus"), "Directory for in-progress tus upload state (optional)")
+		chunkDir  = flag.String("chunk-dir", filepath.Join(os.TempDir(), "ezdrop-chunks"), "Directory for in-progress chunked upload state (optional)")
+		dedupe    = flag.Bool("dedupe", false, "Store uploads as content-defined chunks in a dedupe-aware CAS (optional, default: false)")
+
+		backendKind = flag.String("backend", "local", "Storage backend: \"local\" or \"s3\" (optional, default: local)")
+		s3Bucket    = flag.String("s3-bucket", os.Getenv("EZDROP_S3_BUCKET"), "S3/B2 bucket name (optional, env: EZDROP_S3_BUCKET)")
+		s3Endpoint  = flag.String("s3-endpoint", os.Getenv("EZDROP_S3_ENDPOINT"), "S3-compatible endpoint URL, e.g. a Backblaze B2 endpoint (optional, env: EZDROP_S3_ENDPOINT)")
+		s3Prefix    = flag.String("s3-prefix", os.Getenv("EZDROP_S3_PREFIX"), "Key prefix under the bucket to serve (optional, env: EZDROP_S3_PREFIX)")
+		s3Region    = flag.String("s3-region", os.Getenv("EZDROP_S3_REGION"), "S3/B2 region (optional, env: EZDROP_S3_REGION)")
+
+		downloadConcurrency = flag.Int("download-concurrency", DefaultDownloadConfig.Concurrency, "Number of parallel workers for a single-file download (optional)")
+		downloadChunkSize   = flag.Int64("download-chunk-size", DefaultDownloadConfig.ChunkSize, "Size in bytes of each worker's slice for a parallel download (optional)")
 	)
 
 	// Parse flags
@@ -84,15 +97,53 @@ func main() {
 	fs := http.FileServer(http.FS(content))
 	http.Handle("/static/", fs)
 
+	if *dedupe {
+		// The CAS is local-disk-only (see cas.go): dedupe writes always go
+		// through writeDedupedFile straight to baseDir, bypassing whatever
+		// Backend was selected, and handleList's non-manifest path for a
+		// remote backend lists via backend.ReadDir, which never sees that
+		// local-only manifest. Combining the two would silently make
+		// deduped uploads vanish from the listing, so refuse it outright
+		// until that interaction is reconciled.
+		if *backendKind != "local" {
+			log.Fatalf("-dedupe is not supported with -backend=%s: dedupe always writes to the local CAS, so deduped uploads would not appear in a %s listing", *backendKind, *backendKind)
+		}
+		if err := os.MkdirAll(casDir(baseDir), 0o755); err != nil {
+			log.Fatalf("Unable to create CAS directory: %v", err)
+		}
+	}
+
+	downloadConfig := DownloadConfig{Concurrency: *downloadConcurrency, ChunkSize: *downloadChunkSize}
+
+	backend, err := NewBackend(BackendConfig{
+		Kind:        *backendKind,
+		BaseDir:     baseDir,
+		S3Bucket:    *s3Bucket,
+		S3Endpoint:  *s3Endpoint,
+		S3Prefix:    *s3Prefix,
+		S3Region:    *s3Region,
+		S3AccessKey: os.Getenv("EZDROP_S3_ACCESS_KEY"),
+		S3SecretKey: os.Getenv("EZDROP_S3_SECRET_KEY"),
+	})
+	if err != nil {
+		log.Fatalf("Unable to initialize %q backend: %v", *backendKind, err)
+	}
+
+	hub := NewHub()
+	go hub.Run()
+
 	// Apply security middleware to all handlers
 	http.HandleFunc("/", SecurityMiddleware(securityConfig, handleIndex(baseDir)))
-	http.HandleFunc("/ws", SecurityMiddleware(securityConfig, handleWebSocket))
-	http.HandleFunc("/api/list", SecurityMiddleware(securityConfig, handleList(baseDir)))
-	http.HandleFunc("/api/upload", SecurityMiddleware(securityConfig, handleUpload(baseDir)))
-	http.HandleFunc("/api/download", SecurityMiddleware(securityConfig, handleDownload(baseDir)))
-	http.HandleFunc("/api/upload/chunk", SecurityMiddleware(securityConfig, handleChunkUpload(baseDir)))
-
-	log.Printf("Starting server on :%s serving directory %s (read-only: %v)", *port, baseDir, *readOnly)
+	http.HandleFunc("/ws", SecurityMiddleware(securityConfig, handleWebSocket(hub)))
+	http.HandleFunc("/api/list", SecurityMiddleware(securityConfig, handleList(backend, baseDir)))
+	http.HandleFunc("/api/upload", SecurityMiddleware(securityConfig, handleUpload(backend, baseDir, *dedupe, hub)))
+	http.HandleFunc("/api/download", SecurityMiddleware(securityConfig, handleDownload(backend, baseDir, downloadConfig)))
+	http.HandleFunc("/api/upload/chunk", SecurityMiddleware(securityConfig, handleChunkUpload(backend, baseDir, *chunkDir, *dedupe, hub)))
+	http.HandleFunc("/api/upload/chunk/status", SecurityMiddleware(securityConfig, handleChunkStatus(*chunkDir)))
+	http.HandleFunc("/api/tus/", SecurityMiddleware(securityConfig, handleTus(baseDir, *tusDir, securityConfig, hub)))
+	http.HandleFunc("/api/gc", SecurityMiddleware(securityConfig, handleGC(baseDir)))
+
+	log.Printf("Starting server on :%s serving directory %s (read-only: %v, dedupe: %v, backend: %s)", *port, baseDir, *readOnly, *dedupe, *backendKind)
 	if err := http.ListenAndServe(":"+*port, nil); err != nil {
 		log.Fatal(err)
 	}
@@ -111,13 +162,12 @@ func handleIndex(baseDir string) http.HandlerFunc {
 	}
 }
 
-func handleList(baseDir string) http.HandlerFunc {
+func handleList(backend Backend, baseDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		dir := r.URL.Query().Get("dir")
-		if dir == "" {
-			dir = baseDir
-		} else {
-			dir = filepath.Join(baseDir, dir)
+		relDir := r.URL.Query().Get("dir")
+		dir := baseDir
+		if relDir != "" {
+			dir = filepath.Join(baseDir, relDir)
 		}
 
 		// Prevent directory traversal
@@ -126,7 +176,7 @@ func handleList(baseDir string) http.HandlerFunc {
 			return
 		}
 
-		entries, err := os.ReadDir(dir)
+		entries, err := backend.ReadDir(relDir)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -135,21 +185,34 @@ func handleList(baseDir string) http.HandlerFunc {
 		// Separate directories and files
 		var dirs, regularFiles []FileInfo
 		for _, entry := range entries {
-			info, err := entry.Info()
-			if err != nil {
+			if entry.Name == ".ezdrop" {
 				continue
 			}
 
-			relPath, _ := filepath.Rel(baseDir, filepath.Join(dir, entry.Name()))
+			name := entry.Name
+			size := entry.Size
+
+			// Manifests stand in for the deduped file they describe, so
+			// list them under their logical name and size, not the
+			// sidecar's. The CAS is local-disk-only, so this only ever
+			// matches with the local backend.
+			if !entry.IsDir && isManifestPath(name) {
+				if m, err := readManifest(filepath.Join(dir, name)); err == nil {
+					name = strings.TrimSuffix(name, manifestExt)
+					size = m.Size
+				}
+			}
+
+			relPath, _ := filepath.Rel(baseDir, filepath.Join(dir, name))
 			fileInfo := FileInfo{
-				Name:    entry.Name(),
+				Name:    name,
 				Path:    relPath,
-				Size:    info.Size(),
-				IsDir:   entry.IsDir(),
-				ModTime: info.ModTime().Format(time.RFC3339),
+				Size:    size,
+				IsDir:   entry.IsDir,
+				ModTime: entry.ModTime.Format(time.RFC3339),
 			}
 
-			if entry.IsDir() {
+			if entry.IsDir {
 				dirs = append(dirs, fileInfo)
 			} else {
 				regularFiles = append(regularFiles, fileInfo)
@@ -172,39 +235,17 @@ func handleList(baseDir string) http.HandlerFunc {
 	}
 }
 
-type UploadProgress struct {
-	FileName string  `json:"fileName"`
-	Progress float64 `json:"progress"`
-}
-
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Keep connection alive for progress updates
-	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
-			break
-		}
-	}
-}
-
-func handleUpload(baseDir string) http.HandlerFunc {
+func handleUpload(backend Backend, baseDir string, dedupe bool, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		targetDir := r.URL.Query().Get("dir")
-		if targetDir == "" {
-			targetDir = baseDir
-		} else {
-			targetDir = filepath.Join(baseDir, targetDir)
+		relDir := r.URL.Query().Get("dir")
+		targetDir := baseDir
+		if relDir != "" {
+			targetDir = filepath.Join(baseDir, relDir)
 		}
 
 		if !strings.HasPrefix(targetDir, baseDir) {
@@ -234,23 +275,42 @@ func handleUpload(baseDir string) http.HandlerFunc {
 			defer file.Close()
 
 			targetPath := filepath.Join(targetDir, fileHeader.Filename)
-			dst, err := os.Create(targetPath)
-			if err != nil {
-				log.Printf("Error creating destination file %s: %v", targetPath, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer dst.Close()
+			relPath := filepath.Join(relDir, fileHeader.Filename)
 
-			written, err := io.Copy(dst, file)
-			if err != nil {
-				log.Printf("Error writing file %s: %v", targetPath, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			pw := newProgressWriter(io.Discard, hub, relDir, fileHeader.Filename, fileHeader.Size)
+			source := io.TeeReader(file, pw)
+
+			var written int64
+			if dedupe {
+				// Content-defined dedup always reads/writes the local CAS
+				// directly; it's a local-disk-only feature (see cas.go),
+				// not part of the Backend abstraction.
+				written, err = writeDedupedFile(source, casDir(baseDir), manifestPathFor(targetPath), fileHeader.Filename)
+				if err != nil {
+					log.Printf("Error deduping file %s: %v", targetPath, err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else {
+				dst, err := backend.Create(relPath)
+				if err != nil {
+					log.Printf("Error creating destination file %s: %v", targetPath, err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				defer dst.Close()
+
+				written, err = io.Copy(dst, source)
+				if err != nil {
+					log.Printf("Error writing file %s: %v", targetPath, err)
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 			}
 
 			log.Printf("Successfully uploaded file %s (%d bytes written)", fileHeader.Filename, written)
 			uploadedFiles = append(uploadedFiles, fileHeader.Filename)
+			hub.BroadcastFSChange("created", filepath.Join(relDir, fileHeader.Filename), relDir)
 		}
 
 		// Return success response with uploaded files list
@@ -262,7 +322,7 @@ func handleUpload(baseDir string) http.HandlerFunc {
 	}
 }
 
-func handleDownload(baseDir string) http.HandlerFunc {
+func handleDownload(backend Backend, baseDir string, dlCfg DownloadConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		paths := r.URL.Query()["paths"]
 		if len(paths) == 0 {
@@ -278,17 +338,48 @@ func handleDownload(baseDir string) http.HandlerFunc {
 				return
 			}
 
-			http.ServeFile(w, r, filePath)
+			// The CAS is local-disk-only, so manifests only ever show up
+			// under the local backend.
+			if m, err := readManifest(manifestPathFor(filePath)); err == nil {
+				serveManifest(w, r, m, casDir(baseDir), filepath.Base(filePath))
+				return
+			}
+
+			// Parallel ranged reads go straight at the local file via
+			// (*os.File).ReadAt, so they're only available for the local backend.
+			if r.URL.Query().Has("parallel") || r.Header.Get("Range") != "" {
+				handleParallelDownload(w, r, filePath, filepath.Base(filePath), dlCfg)
+				return
+			}
+
+			// A remote backend can hand the client a presigned URL instead
+			// of streaming the file through this server.
+			if r.URL.Query().Has("redirect") {
+				if presigned, ok := backend.PresignGET(paths[0], 15*time.Minute); ok {
+					http.Redirect(w, r, presigned, http.StatusFound)
+					return
+				}
+			}
+
+			rc, size, err := backend.Open(paths[0])
+			if err != nil {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			defer rc.Close()
+
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(filePath)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+			io.Copy(w, rc)
 			return
 		}
 
 		// Multiple files or force zip
 		w.Header().Set("Content-Type", "application/zip")
 		w.Header().Set("Content-Disposition", "attachment; filename=download.zip")
+		w.Header().Set("Accept-Ranges", "bytes")
 
-		zw := zip.NewWriter(w)
-		defer zw.Close()
-
+		var entries []zipEntry
 		for _, path := range paths {
 			filePath := filepath.Join(baseDir, path)
 			if !strings.HasPrefix(filePath, baseDir) {
@@ -301,202 +392,62 @@ func handleDownload(baseDir string) http.HandlerFunc {
 				}
 
 				if info.IsDir() {
+					if info.Name() == ".ezdrop" {
+						return filepath.SkipDir
+					}
 					return nil
 				}
 
-				relPath, err := filepath.Rel(baseDir, path)
-				if err != nil {
-					return err
-				}
-
-				f, err := zw.Create(relPath)
-				if err != nil {
-					return err
+				if isManifestPath(path) {
+					relPath, err := filepath.Rel(baseDir, strings.TrimSuffix(path, manifestExt))
+					if err != nil {
+						return err
+					}
+					m, err := readManifest(path)
+					if err != nil {
+						return err
+					}
+					entries = append(entries, zipEntry{
+						relPath: relPath,
+						open: func() (io.ReadCloser, int64, error) {
+							sr := io.NewSectionReader(newManifestReader(casDir(baseDir), m), 0, m.Size)
+							return io.NopCloser(sr), m.Size, nil
+						},
+					})
+					return nil
 				}
 
-				src, err := os.Open(path)
+				relPath, err := filepath.Rel(baseDir, path)
 				if err != nil {
 					return err
 				}
-				defer src.Close()
 
-				_, err = io.Copy(f, src)
-				return err
+				entries = append(entries, zipEntry{
+					relPath: relPath,
+					open: func() (io.ReadCloser, int64, error) {
+						f, err := os.Open(path)
+						if err != nil {
+							return nil, 0, err
+						}
+						return f, info.Size(), nil
+					},
+				})
+				return nil
 			})
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
-	}
-}
 
-func handleChunkUpload(baseDir string) http.HandlerFunc {
-	var (
-		activeUploads   = make(map[string]*ChunkedUpload)
-		activeUploadsMu sync.RWMutex
-	)
-
-	// Cleanup routine for abandoned uploads
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			activeUploadsMu.Lock()
-			for id, upload := range activeUploads {
-				if time.Since(upload.LastActivity) > 10*time.Minute {
-					upload.Cleanup()
-					delete(activeUploads, id)
-					log.Printf("Cleaned up abandoned upload: %s", id)
-				}
-			}
-			activeUploadsMu.Unlock()
-		}
-	}()
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		targetDir := r.URL.Query().Get("dir")
-		if targetDir == "" {
-			targetDir = baseDir
-		} else {
-			targetDir = filepath.Join(baseDir, targetDir)
-		}
-
-		if !strings.HasPrefix(targetDir, baseDir) {
-			http.Error(w, "Invalid directory", http.StatusBadRequest)
-			return
-		}
-
-		// Parse chunk info
-		var chunkInfo ChunkInfo
-		if err := json.NewDecoder(r.Body).Decode(&chunkInfo); err != nil {
-			http.Error(w, "Invalid chunk info", http.StatusBadRequest)
-			return
-		}
-
-		// Generate upload ID based on filename and total size
-		uploadID := fmt.Sprintf("%s_%d", chunkInfo.FileName, chunkInfo.TotalSize)
-
-		activeUploadsMu.Lock()
-		upload, exists := activeUploads[uploadID]
-		if !exists {
-			upload = NewChunkedUpload(chunkInfo.FileName, targetDir, chunkInfo.TotalChunks, chunkInfo.TotalSize)
-			activeUploads[uploadID] = upload
-			log.Printf("Started new chunked upload: %s (%d chunks, %d bytes)",
-				chunkInfo.FileName, chunkInfo.TotalChunks, chunkInfo.TotalSize)
-		}
-		activeUploadsMu.Unlock()
-
-		// Handle chunk data
-		chunk := make([]byte, chunkInfo.ChunkSize)
-		_, err := io.ReadFull(r.Body, chunk)
-		if err != nil {
-			http.Error(w, "Error reading chunk data", http.StatusBadRequest)
-			return
-		}
-
-		if err := upload.WriteChunk(chunkInfo.ChunkIndex, chunk); err != nil {
-			http.Error(w, fmt.Sprintf("Error writing chunk: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Check if upload is complete
-		if upload.IsComplete() {
-			if err := upload.Finalize(); err != nil {
-				http.Error(w, fmt.Sprintf("Error finalizing upload: %v", err), http.StatusInternalServerError)
-				return
-			}
-			activeUploadsMu.Lock()
-			delete(activeUploads, uploadID)
-			activeUploadsMu.Unlock()
-			log.Printf("Completed chunked upload: %s", chunkInfo.FileName)
-		}
-
-		w.WriteHeader(http.StatusOK)
-	}
-}
-
-type ChunkedUpload struct {
-	FileName     string
-	TargetPath   string
-	TotalChunks  int
-	TotalSize    int64
-	ReceivedSize int64
-	Chunks       map[int][]byte
-	TempDir      string
-	LastActivity time.Time
-	mu           sync.Mutex
-}
-
-func NewChunkedUpload(fileName, targetDir string, totalChunks int, totalSize int64) *ChunkedUpload {
-	tempDir, err := os.MkdirTemp("", "upload_*")
-	if err != nil {
-		log.Printf("Error creating temp directory: %v", err)
-		return nil
-	}
-
-	return &ChunkedUpload{
-		FileName:     fileName,
-		TargetPath:   filepath.Join(targetDir, fileName),
-		TotalChunks:  totalChunks,
-		TotalSize:    totalSize,
-		Chunks:       make(map[int][]byte),
-		TempDir:      tempDir,
-		LastActivity: time.Now(),
-	}
-}
-
-func (u *ChunkedUpload) WriteChunk(index int, data []byte) error {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-
-	chunkPath := filepath.Join(u.TempDir, fmt.Sprintf("chunk_%d", index))
-	if err := os.WriteFile(chunkPath, data, 0o644); err != nil {
-		return err
-	}
-
-	u.ReceivedSize += int64(len(data))
-	u.LastActivity = time.Now()
-	return nil
-}
-
-func (u *ChunkedUpload) IsComplete() bool {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-	return u.ReceivedSize >= u.TotalSize
-}
-
-func (u *ChunkedUpload) Finalize() error {
-	u.mu.Lock()
-	defer u.mu.Unlock()
-
-	// Create target file
-	dst, err := os.Create(u.TargetPath)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
+		zw := zip.NewWriter(w)
+		defer zw.Close()
 
-	// Combine chunks in order
-	for i := 0; i < u.TotalChunks; i++ {
-		chunkPath := filepath.Join(u.TempDir, fmt.Sprintf("chunk_%d", i))
-		data, err := os.ReadFile(chunkPath)
-		if err != nil {
-			return err
-		}
-		if _, err := dst.Write(data); err != nil {
-			return err
+		if err := writeZipParallel(zw, entries); err != nil {
+			log.Printf("Error writing zip archive: %v", err)
 		}
 	}
-
-	// Cleanup temp files
-	return u.Cleanup()
 }
 
-func (u *ChunkedUpload) Cleanup() error {
-	return os.RemoveAll(u.TempDir)
-}
+// handleChunkUpload and its ChunkedUpload backing type live in
+// chunkedupload.go, alongside handleChunkStatus.
@@ -72,8 +72,11 @@ func SecurityMiddleware(cfg SecurityConfig, next http.HandlerFunc) http.HandlerF
 			}
 		}
 
-		// Read-only mode check for write operations
-		if cfg.ReadOnly && (r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE") {
+		// Read-only mode check for write operations. PATCH is included
+		// because it's the verb tus uses to append bytes to an
+		// in-progress upload, including one created before read-only
+		// mode was turned on.
+		if cfg.ReadOnly && (r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE" || r.Method == "PATCH") {
 			http.Error(w, "Server is in read-only mode", http.StatusForbidden)
 			return
 		}
@@ -82,6 +85,9 @@ func SecurityMiddleware(cfg SecurityConfig, next http.HandlerFunc) http.HandlerF
 		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/api/upload") {
 			r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadSize)
 		}
+		if r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/api/tus/") {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadSize)
+		}
 
 		next(w, r)
 	}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+)
+
+const (
+	tusResumableVersion = "1.0.0"
+	tusExtensions       = "creation,termination"
+	tusExpiryAfter      = 24 * time.Hour
+)
+
+// tusInfo is the sidecar state persisted next to every in-progress tus
+// upload so it survives server restarts.
+type tusInfo struct {
+	ID        string            `json:"id"`
+	Offset    int64             `json:"offset"`
+	Size      int64             `json:"size"`
+	MetaData  map[string]string `json:"metaData"`
+	TargetDir string            `json:"targetDir"`
+	FileName  string            `json:"fileName"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+func (ti *tusInfo) infoPath(tusDir string) string {
+	return filepath.Join(tusDir, ti.ID+".info")
+}
+
+func (ti *tusInfo) partPath(tusDir string) string {
+	return filepath.Join(tusDir, ti.ID)
+}
+
+func (ti *tusInfo) save(tusDir string) error {
+	data, err := json.Marshal(ti)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ti.infoPath(tusDir), data, 0o644)
+}
+
+func loadTusInfo(tusDir, id string) (*tusInfo, error) {
+	data, err := os.ReadFile(filepath.Join(tusDir, id+".info"))
+	if err != nil {
+		return nil, err
+	}
+	var ti tusInfo
+	if err := json.Unmarshal(data, &ti); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+func newTusUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: a comma
+// separated list of "key base64(value)" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	if header == "" {
+		return meta
+	}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		key := parts[0]
+		if key == "" {
+			continue
+		}
+		var value string
+		if len(parts) == 2 {
+			if decoded, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+				value = string(decoded)
+			}
+		}
+		meta[key] = value
+	}
+	return meta
+}
+
+// setTusHeaders writes the headers every tus response must carry.
+func setTusHeaders(w http.ResponseWriter, cfg SecurityConfig) {
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+	w.Header().Set("Tus-Version", tusResumableVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.MaxUploadSize, 10))
+}
+
+// handleTus implements a tus 1.0.0 server: Creation (POST), offset
+// reporting (HEAD), chunked appends (PATCH) and Termination (DELETE).
+// Upload state is kept entirely on disk under tusDir as <id> (the
+// partial file) and <id>.info (a JSON sidecar with offset/size/metadata),
+// so in-flight uploads survive a server restart.
+func handleTus(baseDir, tusDir string, cfg SecurityConfig, hub *Hub) http.HandlerFunc {
+	if err := os.MkdirAll(tusDir, 0o755); err != nil {
+		log.Fatalf("Unable to create tus upload directory: %v", err)
+	}
+
+	go tusExpirySweep(tusDir)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w, cfg)
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tus/"), "/")
+
+		switch r.Method {
+		case "POST":
+			if id != "" {
+				http.Error(w, "Creation requests must target /api/tus/", http.StatusBadRequest)
+				return
+			}
+			handleTusCreate(w, r, baseDir, tusDir, cfg)
+		case "HEAD":
+			handleTusHead(w, r, tusDir, id)
+		case "PATCH":
+			handleTusPatch(w, r, baseDir, tusDir, id, cfg, hub)
+		case "DELETE":
+			handleTusDelete(w, r, tusDir, id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request, baseDir, tusDir string, cfg SecurityConfig) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if size > cfg.MaxUploadSize {
+		http.Error(w, "Upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	fileName := meta["filename"]
+	if fileName == "" {
+		fileName = meta["name"]
+	}
+	if fileName == "" {
+		http.Error(w, "Upload-Metadata must include filename", http.StatusBadRequest)
+		return
+	}
+
+	targetDir := baseDir
+	if dir := meta["dir"]; dir != "" {
+		targetDir = filepath.Join(baseDir, dir)
+	}
+	absTargetDir, err := filepath.Abs(targetDir)
+	if err != nil || !strings.HasPrefix(absTargetDir, baseDir) {
+		http.Error(w, "Invalid directory", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newTusUploadID()
+	if err != nil {
+		http.Error(w, "Unable to allocate upload", http.StatusInternalServerError)
+		return
+	}
+
+	ti := &tusInfo{
+		ID:        id,
+		Size:      size,
+		MetaData:  meta,
+		TargetDir: absTargetDir,
+		FileName:  fileName,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(tusExpiryAfter),
+	}
+
+	f, err := os.Create(ti.partPath(tusDir))
+	if err != nil {
+		http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	if err := ti.save(tusDir); err != nil {
+		http.Error(w, "Unable to persist upload state", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Started tus upload %s for %s (%d bytes)", id, fileName, size)
+
+	w.Header().Set("Location", "/api/tus/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, r *http.Request, tusDir, id string) {
+	ti, err := loadTusInfo(tusDir, id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(ti.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(ti.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request, baseDir, tusDir, id string, cfg SecurityConfig, hub *Hub) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Unsupported Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	ti, err := loadTusInfo(tusDir, id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	if offset != ti.Offset {
+		http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(ti.partPath(tusDir), os.O_WRONLY, 0o644)
+	if err != nil {
+		http.Error(w, "Unable to open upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, "Unable to seek upload", http.StatusInternalServerError)
+		return
+	}
+
+	written, err := io.Copy(f, io.LimitReader(r.Body, ti.Size-offset))
+	ti.Offset += written
+	ti.ExpiresAt = time.Now().Add(tusExpiryAfter)
+	if saveErr := ti.save(tusDir); saveErr != nil {
+		log.Printf("Error persisting tus upload %s: %v", id, saveErr)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error writing chunk: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	relDir, _ := filepath.Rel(baseDir, ti.TargetDir)
+	hub.BroadcastProgress(relDir, ti.FileName, ti.Offset, ti.Size, 0)
+
+	if ti.Offset >= ti.Size {
+		if err := finalizeTusUpload(tusDir, ti); err != nil {
+			http.Error(w, fmt.Sprintf("Error finalizing upload: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Completed tus upload %s -> %s", id, ti.FileName)
+		hub.BroadcastFSChange("created", filepath.Join(relDir, ti.FileName), relDir)
+	}
+
+	setTusHeaders(w, cfg)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(ti.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleTusDelete(w http.ResponseWriter, r *http.Request, tusDir, id string) {
+	ti, err := loadTusInfo(tusDir, id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	os.Remove(ti.partPath(tusDir))
+	os.Remove(ti.infoPath(tusDir))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeTusUpload moves the completed partial file into place, enforcing
+// chroot by re-checking the resolved target against the prefix of
+// ti.TargetDir (which handleTusCreate already checked against baseDir).
+func finalizeTusUpload(tusDir string, ti *tusInfo) error {
+	targetPath := filepath.Join(ti.TargetDir, ti.FileName)
+	absTargetPath, err := filepath.Abs(targetPath)
+	if err != nil || !strings.HasPrefix(absTargetPath, ti.TargetDir) {
+		return fmt.Errorf("invalid target path")
+	}
+
+	if err := os.Rename(ti.partPath(tusDir), absTargetPath); err != nil {
+		return err
+	}
+	os.Remove(ti.infoPath(tusDir))
+	return nil
+}
+
+// tusExpirySweep periodically removes expired .info/partial file pairs,
+// replacing the old in-memory activeUploads cleanup loop.
+func tusExpirySweep(tusDir string) {
+	for {
+		time.Sleep(10 * time.Minute)
+		entries, err := os.ReadDir(tusDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".info") {
+				continue
+			}
+			id := strings.TrimSuffix(entry.Name(), ".info")
+			ti, err := loadTusInfo(tusDir, id)
+			if err != nil {
+				continue
+			}
+			if time.Now().After(ti.ExpiresAt) {
+				os.Remove(ti.partPath(tusDir))
+				os.Remove(ti.infoPath(tusDir))
+				log.Printf("Expired tus upload: %s", id)
+			}
+		}
+	}
+}